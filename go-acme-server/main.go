@@ -1,22 +1,56 @@
 package main
 
 import (
+	"bufio"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
 	"github.com/go-acme/lego/v4/registration"
+	"golang.org/x/crypto/ocsp"
 )
 
+const (
+	challengeHTTP01    = "http01"
+	challengeTLSALPN01 = "tlsalpn01"
+	challengeDNS01     = "dns01"
+)
+
+// renewBefore is how long before NotAfter the background goroutine renews
+// the served certificate.
+const renewBefore = 30 * 24 * time.Hour
+
+type domainList []string
+
+func (d *domainList) String() string { return strings.Join(*d, ",") }
+
+func (d *domainList) Set(v string) error {
+	*d = append(*d, v)
+	return nil
+}
+
 type MyUser struct {
 	email string
 	pk    crypto.PrivateKey
@@ -38,7 +72,22 @@ func (u *MyUser) GetPrivateKey() crypto.PrivateKey {
 	return u.pk
 }
 
-func writeCertFile(name string, content []byte) error {
+// manualDNSProvider satisfies challenge.Provider by printing the TXT record
+// the user has to create and waiting for them to confirm it has propagated.
+type manualDNSProvider struct{}
+
+func (m *manualDNSProvider) Present(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	fmt.Printf("create the following TXT record, then press enter:\n  %s TXT %s\n", fqdn, value)
+	_, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return err
+}
+
+func (m *manualDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+func writeFile(name string, content []byte) error {
 	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
@@ -48,10 +97,248 @@ func writeCertFile(name string, content []byte) error {
 	return err
 }
 
-func run(addr string) error {
+func loadOrCreateAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: not a PEM file", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
 	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return fmt.Errorf("generating private key failed: %w", err)
+		return nil, fmt.Errorf("generating private key failed: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := writeFile(path, pemBytes); err != nil {
+		return nil, fmt.Errorf("failed to persist account key: %w", err)
+	}
+	return pk, nil
+}
+
+func loadRegistration(path string) (*registration.Resource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var reg registration.Resource
+	if err := json.Unmarshal(data, &reg); err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+func saveRegistration(path string, reg *registration.Resource) error {
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// certStore holds the currently-served certificate so the renewal and OCSP
+// goroutines can swap it out without racing the TLS handshake path.
+type certStore struct {
+	v atomic.Value // *tls.Certificate
+}
+
+func (s *certStore) Get() *tls.Certificate {
+	return s.v.Load().(*tls.Certificate)
+}
+
+func (s *certStore) Set(cert *tls.Certificate) {
+	s.v.Store(cert)
+}
+
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Get(), nil
+}
+
+func loadTLSCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// refreshOCSPStaple fetches a fresh stapled OCSP response for cert and
+// returns an updated copy with OCSPStaple set. If the leaf names no OCSP
+// server, cert is returned unchanged.
+func refreshOCSPStaple(cert *tls.Certificate, issuer *x509.Certificate) (*tls.Certificate, error) {
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return cert, nil
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ocsp.CreateRequest: %w", err)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, cert.Leaf.OCSPServer[0], strings.NewReader(string(req)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("fetching OCSP response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	staple, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading OCSP response: %w", err)
+	}
+	if _, err := ocsp.ParseResponseForCert(staple, cert.Leaf, issuer); err != nil {
+		return nil, fmt.Errorf("validating OCSP response: %w", err)
+	}
+
+	updated := *cert
+	updated.OCSPStaple = staple
+	return &updated, nil
+}
+
+func parseIssuer(certFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	var block *pem.Block
+	var leafDone bool
+	for {
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no issuer certificate found in bundle", certFile)
+		}
+		if !leafDone {
+			leafDone = true
+			continue
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+}
+
+// renewalLoop checks the served certificate's expiry once a day and renews
+// it through client when less than renewBefore remains, persisting the new
+// cert/key and swapping the served certificate atomically.
+func renewalLoop(cl *lego.Client, domains []string, certFile, keyFile string, store *certStore) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		cert := store.Get()
+		if time.Until(cert.Leaf.NotAfter) > renewBefore {
+			continue
+		}
+		log.Println("certificate expires soon, renewing:", cert.Leaf.NotAfter)
+
+		certPEM, err := os.ReadFile(certFile)
+		if err != nil {
+			log.Println("failed to read certificate for renewal:", err)
+			continue
+		}
+		keyPEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			log.Println("failed to read private key for renewal:", err)
+			continue
+		}
+		certRes := certificate.Resource{
+			Domain:      domains[0],
+			PrivateKey:  keyPEM,
+			Certificate: certPEM,
+		}
+		newCert, err := cl.Certificate.Renew(certRes, true, false, "")
+		if err != nil {
+			log.Println("renewal failed:", err)
+			continue
+		}
+		if err := writeFile(certFile, newCert.Certificate); err != nil {
+			log.Println("failed to persist renewed certificate:", err)
+			continue
+		}
+		if err := writeFile(keyFile, newCert.PrivateKey); err != nil {
+			log.Println("failed to persist renewed private key:", err)
+			continue
+		}
+		loaded, err := loadTLSCertificate(certFile, keyFile)
+		if err != nil {
+			log.Println("failed to load renewed certificate:", err)
+			continue
+		}
+		store.Set(loaded)
+		log.Println("renewed certificate, new NotAfter:", loaded.Leaf.NotAfter)
+	}
+}
+
+// ocspLoop refreshes the stapled OCSP response on the served certificate
+// periodically.
+func ocspLoop(certFile string, store *certStore) {
+	ticker := time.NewTicker(12 * time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		issuer, err := parseIssuer(certFile)
+		if err != nil {
+			log.Println("ocsp: loading issuer failed:", err)
+			continue
+		}
+		updated, err := refreshOCSPStaple(store.Get(), issuer)
+		if err != nil {
+			log.Println("ocsp: refresh failed:", err)
+			continue
+		}
+		store.Set(updated)
+	}
+}
+
+func setupChallenge(cl *lego.Client, challengeType, dnsProviderName string) error {
+	switch challengeType {
+	case challengeHTTP01:
+		return cl.Challenge.SetHTTP01Provider(http01.NewProviderServer("", "5080"))
+	case challengeTLSALPN01:
+		return cl.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", "5001"))
+	case challengeDNS01:
+		var provider challenge.Provider
+		switch dnsProviderName {
+		case "manual":
+			provider = &manualDNSProvider{}
+		case "cloudflare":
+			p, err := cloudflare.NewDNSProvider()
+			if err != nil {
+				return fmt.Errorf("cloudflare DNS provider setup failed: %w", err)
+			}
+			provider = p
+		default:
+			return fmt.Errorf("unknown DNS provider %q, must be one of manual, cloudflare", dnsProviderName)
+		}
+		return cl.Challenge.SetDNS01Provider(provider)
+	default:
+		return fmt.Errorf("unknown challenge type %q, must be one of %s, %s, %s", challengeType, challengeHTTP01, challengeTLSALPN01, challengeDNS01)
+	}
+}
+
+func run(addr string, domains []string, challengeType, dnsProviderName, certDir string) error {
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return fmt.Errorf("creating cert dir failed: %w", err)
+	}
+
+	pk, err := loadOrCreateAccountKey(filepath.Join(certDir, "account.key"))
+	if err != nil {
+		return fmt.Errorf("loading account key failed: %w", err)
 	}
 	user := MyUser{email: "me@example.com", pk: pk}
 	cfg := lego.NewConfig(&user)
@@ -64,42 +351,85 @@ func run(addr string) error {
 	if err != nil {
 		return fmt.Errorf("lego client setup failed: %w", err)
 	}
-	err = cl.Challenge.SetHTTP01Provider(http01.NewProviderServer("", "5080"))
-	if err != nil {
-		return fmt.Errorf("HTTP-01 challenge setup failed: %w", err)
+	if err := setupChallenge(cl, challengeType, dnsProviderName); err != nil {
+		return fmt.Errorf("%s challenge setup failed: %w", challengeType, err)
 	}
-	reg, err := cl.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+
+	regPath := filepath.Join(certDir, "registration.json")
+	reg, err := loadRegistration(regPath)
 	if err != nil {
-		return fmt.Errorf("client account registratin failed: %w", err)
+		return fmt.Errorf("loading registration failed: %w", err)
+	}
+	if reg == nil {
+		reg, err = cl.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		if err != nil {
+			return fmt.Errorf("client account registratin failed: %w", err)
+		}
+		if err := saveRegistration(regPath, reg); err != nil {
+			return fmt.Errorf("persisting registration failed: %w", err)
+		}
 	}
 	user.reg = reg
-	certs, err := cl.Certificate.Obtain(certificate.ObtainRequest{
-		Domains: []string{"localhost"},
-		Bundle:  true,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to obtain certificates: %w", err)
+
+	certFile := filepath.Join(certDir, domains[0]+".crt")
+	keyFile := filepath.Join(certDir, domains[0]+".key")
+
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		certs, err := cl.Certificate.Obtain(certificate.ObtainRequest{
+			Domains: domains,
+			Bundle:  true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to obtain certificates: %w", err)
+		}
+		if err := writeFile(certFile, certs.Certificate); err != nil {
+			return fmt.Errorf("failed to open certificate file for writing: %w", err)
+		}
+		if err := writeFile(keyFile, certs.PrivateKey); err != nil {
+			return fmt.Errorf("failed to open private key file for writing: %w", err)
+		}
 	}
+	// openssl x509 -text -noout -in <cert-file>
 
-	certFile, keyFile := "cert-"+certs.Domain+".crt", "cert-"+certs.Domain+".key"
-	err = writeCertFile(certFile, certs.Certificate)
+	cert, err := loadTLSCertificate(certFile, keyFile)
 	if err != nil {
-		return fmt.Errorf("failed to open certificate file for writing: %w", err)
+		return fmt.Errorf("loading issued certificate failed: %w", err)
 	}
-	err = writeCertFile(keyFile, certs.PrivateKey)
-	if err != nil {
-		return fmt.Errorf("failed to open private key file for writing: %w", err)
+	store := &certStore{}
+	store.Set(cert)
+
+	go renewalLoop(cl, domains, certFile, keyFile, store)
+	go ocspLoop(certFile, store)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "Hello, World!") }),
+		TLSConfig: &tls.Config{
+			GetCertificate: store.GetCertificate,
+		},
 	}
-	// openssl x509 -text -noout -in cert-localhost.crt
 
 	log.Println("listening on:", addr)
-	return http.ListenAndServeTLS(addr, certFile, keyFile, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "Hello, World!") }))
+	return srv.ListenAndServeTLS("", "")
 }
 
 func main() {
-	addr := os.Args[1]
+	var domains domainList
+	flag.Var(&domains, "domain", "domain to include in the certificate's SAN list; may be repeated")
+	challengeType := flag.String("challenge", challengeHTTP01, "ACME challenge type: http01, tlsalpn01, dns01")
+	dnsProviderName := flag.String("dns-provider", "manual", "DNS-01 provider: manual, cloudflare (only used with --challenge dns01)")
+	certDir := flag.String("cert-dir", "./acme-data", "directory to persist the account key, registration and issued certificate in")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("USAGE: %s [flags] <listen-addr>", os.Args[0])
+	}
+	addr := flag.Arg(0)
+	if len(domains) == 0 {
+		domains = domainList{"localhost"}
+	}
 
-	err := run(addr)
+	err := run(addr, domains, *challengeType, *dnsProviderName, *certDir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,122 @@
+// Package codec provides the pooled zstd encoder/decoder and the
+// shared-dictionary training logic used by both the crawshaw and mattn
+// SQLite BLOB benchmarks, so the two drivers stay byte-for-byte comparable
+// instead of carrying their own near-identical copies.
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SampleFiles and SampleBytes bound how much of the test corpus is used to
+// build the shared zstd-dict dictionary.
+const (
+	SampleFiles = 32
+	SampleBytes = 64 * 1024
+)
+
+// rawDictID is the dictionary id TrainDict's output is registered under.
+// WithEncoderDictRaw/WithDecoderDictRaw take arbitrary content under an id
+// instead of requiring the magic-header'd format a real `zstd --train`
+// dictionary has, which is what TrainDict's naive concatenation produces.
+const rawDictID = 1
+
+// Pool hands out pooled zstd encoders/decoders so concurrent workers don't
+// pay allocation cost on every file. Sized to the run's concurrency level
+// since that's the maximum number of in-flight codec users.
+type Pool struct {
+	encoders chan *zstd.Encoder
+	decoders chan *zstd.Decoder
+}
+
+// NewPool creates a Pool sized for concurrency workers. If dict is non-nil,
+// every encoder/decoder in the pool is primed with it.
+func NewPool(concurrency int, dict []byte) (*Pool, error) {
+	p := &Pool{
+		encoders: make(chan *zstd.Encoder, concurrency),
+		decoders: make(chan *zstd.Decoder, concurrency),
+	}
+	for i := 0; i < concurrency; i++ {
+		var encOpts []zstd.EOption
+		var decOpts []zstd.DOption
+		if dict != nil {
+			encOpts = append(encOpts, zstd.WithEncoderDictRaw(rawDictID, dict))
+			decOpts = append(decOpts, zstd.WithDecoderDictRaw(rawDictID, dict))
+		}
+		enc, err := zstd.NewWriter(nil, encOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewWriter: %w", err)
+		}
+		dec, err := zstd.NewReader(nil, decOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewReader: %w", err)
+		}
+		p.encoders <- enc
+		p.decoders <- dec
+	}
+	return p, nil
+}
+
+func (p *Pool) GetEncoder() *zstd.Encoder {
+	return <-p.encoders
+}
+
+func (p *Pool) PutEncoder(enc *zstd.Encoder) {
+	p.encoders <- enc
+}
+
+func (p *Pool) GetDecoder() *zstd.Decoder {
+	return <-p.decoders
+}
+
+func (p *Pool) PutDecoder(dec *zstd.Decoder) {
+	p.decoders <- dec
+}
+
+func (p *Pool) Close() {
+	close(p.encoders)
+	for enc := range p.encoders {
+		enc.Close()
+	}
+	close(p.decoders)
+	for dec := range p.decoders {
+		dec.Close()
+	}
+}
+
+// TrainDict builds a shared zstd dictionary from a random sample of n files
+// out of dir. klauspost/compress/zstd doesn't ship a COVER/FastCover
+// trainer, so this approximates one by concatenating truncated samples.
+// corpus.Generate writes random bytes with no shared headers, so only
+// content that repeats a sample, such as the exact duplicates a nonzero
+// dupRatio creates, matches the dictionary.
+func TrainDict(dir string, n int) ([]byte, error) {
+	tFiles, err := filepath.Glob(dir + "/*.bin")
+	if err != nil {
+		return nil, err
+	}
+	rand.Shuffle(len(tFiles), func(i, j int) {
+		tFiles[i], tFiles[j] = tFiles[j], tFiles[i]
+	})
+	if n > len(tFiles) {
+		n = len(tFiles)
+	}
+	var buf bytes.Buffer
+	for _, tFile := range tFiles[:n] {
+		data, err := ioutil.ReadFile(tFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > SampleBytes {
+			data = data[:SampleBytes]
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+// Package corpus generates the random test-file corpus shared by the
+// crawshaw and mattn SQLite BLOB benchmarks.
+package corpus
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// Generate writes nFiles test files into dir, each sized randomly between
+// minSize and maxSize bytes. dupRatio controls what fraction of them are
+// exact content duplicates of an earlier file instead of fresh random
+// bytes, so --dedup runs can be benchmarked against a workload with a known
+// amount of duplicate content.
+func Generate(dir string, nFiles, minSize, maxSize int, dupRatio float64) error {
+	uniqueFiles := nFiles - int(float64(nFiles)*dupRatio)
+	if uniqueFiles < 1 {
+		uniqueFiles = 1
+	}
+	for i := 0; i < nFiles; i++ {
+		fName := fmt.Sprintf("%d.bin", i)
+		path := filepath.Join(dir, fName)
+
+		if i >= uniqueFiles {
+			srcName := fmt.Sprintf("%d.bin", i%uniqueFiles)
+			src, err := os.Open(filepath.Join(dir, srcName))
+			if err != nil {
+				return err
+			}
+			dst, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				src.Close()
+				return err
+			}
+			_, err = io.Copy(dst, src)
+			src.Close()
+			dst.Close()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("created testfile: %s (duplicate of %s)\n", path, srcName)
+			continue
+		}
+
+		size := minSize + rand.Intn(maxSize-minSize)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// write in chunks of 8M to save RAM
+		chunkSize := 8 * 1024 * 1024
+		chunk := make([]byte, chunkSize)
+		for size > 0 {
+			n := chunkSize
+			if size < chunkSize {
+				n = size
+			}
+			_, err = rand.Read(chunk[:n])
+			if err != nil {
+				return err
+			}
+			size -= n
+			_, err = f.Write(chunk[:n])
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Println("created testfile:", f.Name())
+	}
+	return nil
+}
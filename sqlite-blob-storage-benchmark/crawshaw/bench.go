@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,171 +16,459 @@ import (
 	"time"
 
 	"crawshaw.io/sqlite/sqlitex"
+	codecpool "github.com/klingtnet/playground/sqlite-blob-storage-benchmark/codec"
+	"github.com/klingtnet/playground/sqlite-blob-storage-benchmark/corpus"
+	"github.com/klingtnet/playground/sqlite-blob-storage-benchmark/stats"
 )
 
-func prepareFiles(dir string, nFiles, minSize, maxSize int) error {
-	for i := 0; i < nFiles; i++ {
-		size := minSize + rand.Intn(maxSize-minSize)
-		fName := fmt.Sprintf("%d.bin", i)
-		f, err := os.OpenFile(filepath.Join(dir, fName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		// write in chunks of 8M to save RAM
-		chunkSize := 8 * 1024 * 1024
-		chunk := make([]byte, chunkSize)
-		for size > 0 {
-			n := chunkSize
-			if size < chunkSize {
-				n = size
-			}
-			_, err = rand.Read(chunk[:n])
-			if err != nil {
-				return err
-			}
-			size -= n
-			_, err = f.Write(chunk[:n])
-			if err != nil {
-				return err
-			}
-		}
-		fmt.Println("created testfile:", f.Name())
+const (
+	codecNone     = "none"
+	codecZstd     = "zstd"
+	codecZstdDict = "zstd-dict"
+)
+
+func storeDict(ctx context.Context, dbPool *sqlitex.Pool, dict []byte) error {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`CREATE TABLE codec_meta (name TEXT NOT NULL PRIMARY KEY, dict BLOB);`)
+	if err != nil {
+		return err
+	}
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("CREATE codec_meta stmt.Step: %w", err)
+	}
+
+	stmt, err = conn.Prepare(`INSERT INTO codec_meta (name, dict) VALUES($name, $dict);`)
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$name", codecZstdDict)
+	stmt.SetBytes("$dict", dict)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("INSERT codec_meta stmt.Step: %w", err)
 	}
 	return nil
 }
 
-func prepareDatabase(ctx context.Context, dbPool *sqlitex.Pool, dir string, nFiles int) error {
+func loadDict(ctx context.Context, dbPool *sqlitex.Pool) ([]byte, error) {
 	conn := dbPool.Get(ctx)
 	if conn == nil {
-		return fmt.Errorf("no connection in pool available")
+		return nil, fmt.Errorf("no connection in pool available")
 	}
 	defer dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`SELECT dict FROM codec_meta WHERE name = $name`)
+	if err != nil {
+		return nil, err
+	}
+	stmt.SetText("$name", codecZstdDict)
+	ok, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no codec_meta row for %s", codecZstdDict)
+	}
+	return ioutil.ReadAll(stmt.GetReader("dict"))
+}
+
+func prepareDatabase(ctx context.Context, dbPool *sqlitex.Pool, dir string, nFiles int, codec string, pool *codecpool.Pool) (fileStats, error) {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return fileStats{}, fmt.Errorf("no connection in pool available")
+	}
 	stmt, err := conn.Prepare(`CREATE TABLE files (name TEXT NOT NULL PRIMARY KEY, data BLOB);`)
 	if err != nil {
-		return err
+		dbPool.Put(conn)
+		return fileStats{}, err
 	}
 	_, err = stmt.Step()
+	dbPool.Put(conn)
 	if err != nil {
-		return fmt.Errorf("CREATE stmt.Step: %w", err)
+		return fileStats{}, fmt.Errorf("CREATE stmt.Step: %w", err)
 	}
 
 	tFiles, err := filepath.Glob(dir + "/*.bin")
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	if len(tFiles) != nFiles {
-		return fmt.Errorf("expected %d test files but was %d", nFiles, len(tFiles))
+		return fileStats{}, fmt.Errorf("expected %d test files but was %d", nFiles, len(tFiles))
 	}
+	var total fileStats
 	for _, tFile := range tFiles {
-		err = insertFile(ctx, dbPool, tFile)
+		stats, err := insertFile(ctx, dbPool, tFile, codec, pool)
 		if err != nil {
-			return err
+			return fileStats{}, err
 		}
+		total.origBytes += stats.origBytes
+		total.storedBytes += stats.storedBytes
+		total.codecDur += stats.codecDur
 
 		fmt.Printf("stored %s in database\n", tFile)
 	}
 
-	return nil
+	return total, nil
 }
 
-func insertFile(ctx context.Context, dbPool *sqlitex.Pool, name string) error {
+// fileStats reports, for a single insertFile/selectFile call, the original
+// byte count and the time spent in the codec, separate from the time spent
+// doing SQLite I/O. storedBytes is set by insertFile only.
+type fileStats struct {
+	origBytes   int64
+	storedBytes int64
+	codecDur    time.Duration
+}
+
+func insertFile(ctx context.Context, dbPool *sqlitex.Pool, name, codec string, pool *codecpool.Pool) (fileStats, error) {
 	conn := dbPool.Get(ctx)
 	if conn == nil {
-		return fmt.Errorf("no connection in pool available")
+		return fileStats{}, fmt.Errorf("no connection in pool available")
 	}
 	defer dbPool.Put(conn)
 
 	f, err := os.Open(name)
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	defer f.Close()
 	fInfo, err := f.Stat()
 	if err != nil {
-		return err
+		return fileStats{}, err
+	}
+
+	var src io.Reader = f
+	storedSize := fInfo.Size()
+	var codecDur time.Duration
+
+	if codec != codecNone {
+		// Compress to a spooled temp file first: SetZeroBlob needs the final
+		// size up front, and the compressed size isn't known until encoding
+		// finishes. This keeps the compressed bytes off the heap, even
+		// though they land on disk rather than streaming directly.
+		tmp, err := ioutil.TempFile(filepath.Dir(name), "codec-*.zst")
+		if err != nil {
+			return fileStats{}, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		enc := pool.GetEncoder()
+		defer pool.PutEncoder(enc)
+		enc.Reset(tmp)
+
+		codecStart := time.Now()
+		if _, err := io.Copy(enc, f); err != nil {
+			return fileStats{}, fmt.Errorf("zstd encode: %w", err)
+		}
+		if err := enc.Close(); err != nil {
+			return fileStats{}, fmt.Errorf("zstd encoder Close: %w", err)
+		}
+		codecDur = time.Since(codecStart)
+
+		tInfo, err := tmp.Stat()
+		if err != nil {
+			return fileStats{}, err
+		}
+		storedSize = tInfo.Size()
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return fileStats{}, err
+		}
+		src = tmp
 	}
 
 	stmt, err := conn.Prepare(`INSERT INTO files (name, data) VALUES($name, $data);`)
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	stmt.SetText("$name", filepath.Base(name))
-	stmt.SetZeroBlob("$data", fInfo.Size())
+	stmt.SetZeroBlob("$data", storedSize)
 	_, err = stmt.Step()
 	if err != nil {
-		return fmt.Errorf("INSERT stmt.Step: %w", err)
+		return fileStats{}, fmt.Errorf("INSERT stmt.Step: %w", err)
 	}
 	blob, err := conn.OpenBlob("", "files", "data", conn.LastInsertRowID(), true)
 	if err != nil {
-		return fmt.Errorf("conn.OpenBlob: %w", err)
+		return fileStats{}, fmt.Errorf("conn.OpenBlob: %w", err)
 	}
 	defer blob.Close()
-	n, err := io.Copy(blob, f)
+	n, err := io.Copy(blob, src)
 	if err != nil {
-		return fmt.Errorf("io.Copy: %w", err)
+		return fileStats{}, fmt.Errorf("io.Copy: %w", err)
 	}
-	if n != fInfo.Size() {
-		return fmt.Errorf("expected %d bytes to be written but was %d", fInfo.Size(), n)
+	if n != storedSize {
+		return fileStats{}, fmt.Errorf("expected %d bytes to be written but was %d", storedSize, n)
 	}
-	return nil
+	return fileStats{origBytes: fInfo.Size(), storedBytes: storedSize, codecDur: codecDur}, nil
 }
 
-func selectFile(ctx context.Context, dbPool *sqlitex.Pool, filename string) error {
-	conn := dbPool.Get(context.TODO())
+func selectFile(ctx context.Context, dbPool *sqlitex.Pool, filename, codec string, pool *codecpool.Pool) (fileStats, error) {
+	conn := dbPool.Get(ctx)
 	if conn == nil {
-		return fmt.Errorf("no connection in pool available")
+		return fileStats{}, fmt.Errorf("no connection in pool available")
 	}
 	defer dbPool.Put(conn)
 
 	stmt, err := conn.Prepare(`SELECT data FROM files WHERE name = $name`)
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	stmt.SetText("$name", filename)
 	ok, err := stmt.Step()
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	if !ok {
-		return fmt.Errorf("sqlite-crawshaw no data for filename: %s", filename)
+		return fileStats{}, fmt.Errorf("sqlite-crawshaw no data for filename: %s", filename)
 	}
-	n, err := io.Copy(ioutil.Discard, stmt.GetReader("data"))
-	if err != nil {
-		return err
+
+	var src io.Reader = stmt.GetReader("data")
+	var n int64
+	var codecDur time.Duration
+	if codec != codecNone {
+		dec := pool.GetDecoder()
+		defer pool.PutDecoder(dec)
+		if err := dec.Reset(src); err != nil {
+			return fileStats{}, fmt.Errorf("zstd decoder Reset: %w", err)
+		}
+		codecStart := time.Now()
+		n, err = io.Copy(ioutil.Discard, dec)
+		codecDur = time.Since(codecStart)
+		if err != nil {
+			return fileStats{}, fmt.Errorf("zstd decode: %w", err)
+		}
+	} else {
+		n, err = io.Copy(ioutil.Discard, src)
+		if err != nil {
+			return fileStats{}, err
+		}
 	}
 	if n == 0 {
-		return fmt.Errorf("sqlite-crawshaw empty file")
+		return fileStats{}, fmt.Errorf("sqlite-crawshaw empty file")
 	}
 	ok, err = stmt.Step()
 	if ok {
-		return fmt.Errorf("stmt.Step expected no more data")
+		return fileStats{}, fmt.Errorf("stmt.Step expected no more data")
 	}
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 
-	return nil
+	return fileStats{origBytes: n, codecDur: codecDur}, nil
+}
+
+// dedupStats reports, for one insertFileDedup call, the original byte count
+// and whether the content hash already existed (i.e. this insert was a
+// dedup hit rather than a new blob).
+type dedupStats struct {
+	origBytes int64
+	deduped   bool
+}
+
+func prepareDatabaseDedup(ctx context.Context, dbPool *sqlitex.Pool, dir string, nFiles int) (stats.DedupReport, error) {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return stats.DedupReport{}, fmt.Errorf("no connection in pool available")
+	}
+	for _, ddl := range []string{
+		`CREATE TABLE blobs (hash TEXT NOT NULL PRIMARY KEY, size INT NOT NULL, data BLOB NOT NULL);`,
+		`CREATE TABLE files (name TEXT NOT NULL PRIMARY KEY, hash TEXT NOT NULL REFERENCES blobs(hash));`,
+	} {
+		stmt, err := conn.Prepare(ddl)
+		if err != nil {
+			dbPool.Put(conn)
+			return stats.DedupReport{}, err
+		}
+		if _, err := stmt.Step(); err != nil {
+			dbPool.Put(conn)
+			return stats.DedupReport{}, fmt.Errorf("CREATE stmt.Step: %w", err)
+		}
+	}
+	dbPool.Put(conn)
+
+	tFiles, err := filepath.Glob(dir + "/*.bin")
+	if err != nil {
+		return stats.DedupReport{}, err
+	}
+	if len(tFiles) != nFiles {
+		return stats.DedupReport{}, fmt.Errorf("expected %d test files but was %d", nFiles, len(tFiles))
+	}
+	var report stats.DedupReport
+	for _, tFile := range tFiles {
+		dstats, err := insertFileDedup(ctx, dbPool, tFile)
+		if err != nil {
+			return stats.DedupReport{}, err
+		}
+		report.Files++
+		report.OrigBytes += dstats.origBytes
+		if dstats.deduped {
+			report.DedupedFiles++
+		}
+		fmt.Printf("stored %s in database\n", tFile)
+	}
+
+	conn = dbPool.Get(ctx)
+	if conn == nil {
+		return stats.DedupReport{}, fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+	stmt, err := conn.Prepare(`SELECT COALESCE(SUM(size), 0) AS total FROM blobs`)
+	if err != nil {
+		return stats.DedupReport{}, err
+	}
+	if _, err := stmt.Step(); err != nil {
+		return stats.DedupReport{}, err
+	}
+	report.StoredBytes = stmt.GetInt64("total")
+
+	return report, nil
 }
 
-func readFile(filename string) error {
+// insertFileDedup hashes name's content while streaming it into a temp
+// zero-blob row (io.TeeReader feeds both the blob writer and the sha256
+// hasher), then either drops the temp row and points files at the existing
+// blob with that hash, or promotes the temp row's placeholder hash to the
+// real one.
+func insertFileDedup(ctx context.Context, dbPool *sqlitex.Pool, name string) (dedupStats, error) {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return dedupStats{}, fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+
+	f, err := os.Open(name)
+	if err != nil {
+		return dedupStats{}, err
+	}
+	defer f.Close()
+	fInfo, err := f.Stat()
+	if err != nil {
+		return dedupStats{}, err
+	}
+
+	placeholder := fmt.Sprintf("_tmp-%s-%d", filepath.Base(name), time.Now().UnixNano())
+	stmt, err := conn.Prepare(`INSERT INTO blobs (hash, size, data) VALUES($hash, $size, $data);`)
+	if err != nil {
+		return dedupStats{}, err
+	}
+	stmt.SetText("$hash", placeholder)
+	stmt.SetInt64("$size", fInfo.Size())
+	stmt.SetZeroBlob("$data", fInfo.Size())
+	if _, err := stmt.Step(); err != nil {
+		return dedupStats{}, fmt.Errorf("INSERT blobs stmt.Step: %w", err)
+	}
+	rowID := conn.LastInsertRowID()
+
+	blob, err := conn.OpenBlob("", "blobs", "data", rowID, true)
+	if err != nil {
+		return dedupStats{}, fmt.Errorf("conn.OpenBlob: %w", err)
+	}
+	hasher := sha256.New()
+	n, err := io.Copy(blob, io.TeeReader(f, hasher))
+	blob.Close()
+	if err != nil {
+		return dedupStats{}, fmt.Errorf("io.Copy: %w", err)
+	}
+	if n != fInfo.Size() {
+		return dedupStats{}, fmt.Errorf("expected %d bytes to be written but was %d", fInfo.Size(), n)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	existsStmt, err := conn.Prepare(`SELECT 1 FROM blobs WHERE hash = $hash AND rowid != $rowid`)
+	if err != nil {
+		return dedupStats{}, err
+	}
+	existsStmt.SetText("$hash", hash)
+	existsStmt.SetInt64("$rowid", rowID)
+	exists, err := existsStmt.Step()
+	if err != nil {
+		return dedupStats{}, err
+	}
+
+	if exists {
+		delStmt, err := conn.Prepare(`DELETE FROM blobs WHERE rowid = $rowid`)
+		if err != nil {
+			return dedupStats{}, err
+		}
+		delStmt.SetInt64("$rowid", rowID)
+		if _, err := delStmt.Step(); err != nil {
+			return dedupStats{}, fmt.Errorf("DELETE blobs stmt.Step: %w", err)
+		}
+	} else {
+		updStmt, err := conn.Prepare(`UPDATE blobs SET hash = $hash WHERE rowid = $rowid`)
+		if err != nil {
+			return dedupStats{}, err
+		}
+		updStmt.SetText("$hash", hash)
+		updStmt.SetInt64("$rowid", rowID)
+		if _, err := updStmt.Step(); err != nil {
+			return dedupStats{}, fmt.Errorf("UPDATE blobs stmt.Step: %w", err)
+		}
+	}
+
+	fileStmt, err := conn.Prepare(`INSERT INTO files (name, hash) VALUES($name, $hash);`)
+	if err != nil {
+		return dedupStats{}, err
+	}
+	fileStmt.SetText("$name", filepath.Base(name))
+	fileStmt.SetText("$hash", hash)
+	if _, err := fileStmt.Step(); err != nil {
+		return dedupStats{}, fmt.Errorf("INSERT files stmt.Step: %w", err)
+	}
+
+	return dedupStats{origBytes: fInfo.Size(), deduped: exists}, nil
+}
+
+func selectFileDedup(ctx context.Context, dbPool *sqlitex.Pool, filename string) (int64, error) {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return 0, fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`SELECT blobs.data AS data FROM files JOIN blobs ON files.hash = blobs.hash WHERE files.name = $name`)
+	if err != nil {
+		return 0, err
+	}
+	stmt.SetText("$name", filename)
+	ok, err := stmt.Step()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("sqlite-crawshaw no data for filename: %s", filename)
+	}
+	n, err := io.Copy(ioutil.Discard, stmt.GetReader("data"))
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("sqlite-crawshaw empty file")
+	}
+	return n, nil
+}
+
+func readFile(filename string) (int64, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer f.Close()
 	n, err := io.Copy(ioutil.Discard, f)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if n == 0 {
-		return fmt.Errorf("empty file %s", f.Name())
+		return 0, fmt.Errorf("empty file %s", f.Name())
 	}
-	return nil
+	return n, nil
 }
 
-func run(nFiles, minSize, maxSize, concurrency int) error {
+func run(nFiles, minSize, maxSize, concurrency int, codec string, dedup bool, dupRatio float64, rec *stats.Recorder) error {
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -205,7 +496,7 @@ func run(nFiles, minSize, maxSize, concurrency int) error {
 	}()
 
 	rand.Seed(time.Now().UnixNano())
-	err = prepareFiles(tDir, nFiles, minSize, maxSize)
+	err = corpus.Generate(tDir, nFiles, minSize, maxSize, dupRatio)
 	if err != nil {
 		return err
 	}
@@ -215,36 +506,64 @@ func run(nFiles, minSize, maxSize, concurrency int) error {
 		log.Fatal(err)
 	}
 	defer dbPool.Close()
-	err = prepareDatabase(context.TODO(), dbPool, tDir, nFiles)
+
+	if dedup {
+		return runDedup(dbPool, tDir, nFiles, concurrency, rec)
+	}
+
+	var pool *codecpool.Pool
+	if codec != codecNone {
+		var dict []byte
+		if codec == codecZstdDict {
+			dict, err = codecpool.TrainDict(tDir, codecpool.SampleFiles)
+			if err != nil {
+				return fmt.Errorf("codecpool.TrainDict: %w", err)
+			}
+			if err := storeDict(context.TODO(), dbPool, dict); err != nil {
+				return fmt.Errorf("storeDict: %w", err)
+			}
+			dict, err = loadDict(context.TODO(), dbPool)
+			if err != nil {
+				return fmt.Errorf("loadDict: %w", err)
+			}
+		}
+		pool, err = codecpool.NewPool(concurrency, dict)
+		if err != nil {
+			return fmt.Errorf("codecpool.NewPool: %w", err)
+		}
+		defer pool.Close()
+	}
+
+	insertStats, err := prepareDatabase(context.TODO(), dbPool, tDir, nFiles, codec, pool)
 	if err != nil {
 		return err
 	}
 
-	resultCh := make(chan time.Duration)
 	errCh := make(chan error)
 	doneCh := make(chan interface{})
 
 	for i := 0; i < concurrency; i++ {
-		go func() {
+		go func(workerID int) {
 			for j := 0; j < nFiles; j++ {
-				start := time.Now()
 				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
 
-				err = readFile(filepath.Join(tDir, filename))
+				n, err := readFile(filepath.Join(tDir, filename))
 				if err != nil {
 					errCh <- err
+					return
+				}
+				if err := rec.Record("files", workerID, j, filename, n, time.Since(start)); err != nil {
+					errCh <- err
+					return
 				}
-				resultCh <- time.Since(start)
 			}
 			doneCh <- nil
-		}()
+		}(i)
 	}
 	routinesRunning := concurrency
-	var fileTimes []time.Duration
 	for routinesRunning > 0 {
 		select {
-		case t := <-resultCh:
-			fileTimes = append(fileTimes, t)
 		case <-doneCh:
 			routinesRunning--
 		case err := <-errCh:
@@ -252,49 +571,158 @@ func run(nFiles, minSize, maxSize, concurrency int) error {
 		}
 	}
 
+	statsCh := make(chan fileStats)
 	for i := 0; i < concurrency; i++ {
-		go func() {
+		go func(workerID int) {
 			for j := 0; j < nFiles; j++ {
-				start := time.Now()
 				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
 
-				err = selectFile(context.TODO(), dbPool, filename)
+				s, err := selectFile(context.TODO(), dbPool, filename, codec, pool)
 				if err != nil {
 					errCh <- err
+					return
+				}
+				if err := rec.Record("sql", workerID, j, filename, s.origBytes, time.Since(start)); err != nil {
+					errCh <- err
+					return
 				}
-				resultCh <- time.Since(start)
+				statsCh <- s
 			}
 			doneCh <- nil
-		}()
+		}(i)
 	}
 	routinesRunning = concurrency
-	var sqlTimes []time.Duration
+	var selectStats []fileStats
 	for routinesRunning > 0 {
 		select {
-		case t := <-resultCh:
-			sqlTimes = append(sqlTimes, t)
+		case s := <-statsCh:
+			selectStats = append(selectStats, s)
 		case <-doneCh:
 			routinesRunning--
 		case err := <-errCh:
 			return err
 		}
 	}
-	var totalFiles time.Duration
-	for _, v := range fileTimes {
-		totalFiles += v
+
+	var totalSelectCodec time.Duration
+	var totalDecoded int64
+	for _, s := range selectStats {
+		totalDecoded += s.origBytes
+		totalSelectCodec += s.codecDur
+	}
+
+	rec.Report(os.Stdout, "files")
+	rec.Report(os.Stdout, "sql")
+	if codec != codecNone {
+		ratio := float64(insertStats.storedBytes) / float64(insertStats.origBytes)
+		fmt.Printf("codec: %s\toriginal bytes: %d\tstored bytes: %d\tratio: %.3f\n",
+			codec, insertStats.origBytes, insertStats.storedBytes, ratio)
+		fmt.Printf("codec: encode time: %s\tdecode time: %s\tdecoded bytes: %d\n",
+			insertStats.codecDur, totalSelectCodec, totalDecoded)
+	}
+
+	return nil
+}
+
+// runDedup is the --dedup counterpart of run: it uses the content-addressable
+// blobs/files schema instead of the plain files table, and reports the
+// dedup ratio and space saved alongside the usual files:/sql: latency
+// summaries.
+func runDedup(dbPool *sqlitex.Pool, tDir string, nFiles, concurrency int, rec *stats.Recorder) error {
+	report, err := prepareDatabaseDedup(context.TODO(), dbPool, tDir, nFiles)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error)
+	doneCh := make(chan interface{})
+
+	for i := 0; i < concurrency; i++ {
+		go func(workerID int) {
+			for j := 0; j < nFiles; j++ {
+				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
+
+				n, err := readFile(filepath.Join(tDir, filename))
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if err := rec.Record("files", workerID, j, filename, n, time.Since(start)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			doneCh <- nil
+		}(i)
+	}
+	routinesRunning := concurrency
+	for routinesRunning > 0 {
+		select {
+		case <-doneCh:
+			routinesRunning--
+		case err := <-errCh:
+			return err
+		}
 	}
-	var totalSQL time.Duration
-	for _, v := range sqlTimes {
-		totalSQL += v
+
+	for i := 0; i < concurrency; i++ {
+		go func(workerID int) {
+			for j := 0; j < nFiles; j++ {
+				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
+
+				size, err := selectFileDedup(context.TODO(), dbPool, filename)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if err := rec.Record("sql", workerID, j, filename, size, time.Since(start)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			doneCh <- nil
+		}(i)
+	}
+	routinesRunning = concurrency
+	for routinesRunning > 0 {
+		select {
+		case <-doneCh:
+			routinesRunning--
+		case err := <-errCh:
+			return err
+		}
 	}
-	fmt.Printf("total: files: %s\tsql: %s\n", totalFiles, totalSQL)
+
+	rec.Report(os.Stdout, "files")
+	rec.Report(os.Stdout, "sql")
+	report.Report(os.Stdout)
 
 	return nil
 }
 
 func main() {
-	if len(os.Args) != 5 {
-		log.Fatalf("USAGE: %s <nr-of-files> <min-size> <max-size> <concurrency>", os.Args[0])
+	codec := flag.String("codec", codecNone, "blob codec to use for inserts/selects: none, zstd, zstd-dict")
+	dedup := flag.Bool("dedup", false, "store files content-addressed by sha256 hash instead of by name, deduplicating identical content")
+	dupRatio := flag.Float64("dup-ratio", 0, "fraction (0-1) of generated test files that are exact duplicates of an earlier file; only affects test data generation")
+	csvPath := flag.String("csv", "", "if set, stream per-sample (worker,iteration,mode,filename,size,duration_ns) rows to this CSV file")
+	warmup := flag.Int("warmup", 0, "number of leading iterations per worker to discard from the histogram and CSV trace")
+	flag.Parse()
+
+	switch *codec {
+	case codecNone, codecZstd, codecZstdDict:
+	default:
+		log.Fatalf("unknown --codec %q, must be one of none, zstd, zstd-dict", *codec)
+	}
+	if *dedup && *codec != codecNone {
+		log.Fatal("--dedup cannot be combined with --codec")
+	}
+
+	args := flag.Args()
+	if len(args) != 4 {
+		log.Fatalf("USAGE: %s [--codec none|zstd|zstd-dict] [--dedup] [--dup-ratio 0.0-1.0] [--csv path.csv] [--warmup N] <nr-of-files> <min-size> <max-size> <concurrency>", os.Args[0])
 	}
 	mustAtoi := func(s string) int {
 		i, err := strconv.Atoi(s)
@@ -303,15 +731,20 @@ func main() {
 		}
 		return i
 	}
-	nFiles := mustAtoi(os.Args[1])
-	minSize, maxSize := mustAtoi(os.Args[2]), mustAtoi(os.Args[3])
+	nFiles := mustAtoi(args[0])
+	minSize, maxSize := mustAtoi(args[1]), mustAtoi(args[2])
 	if minSize >= maxSize {
 		log.Fatalf("minSize %d must be less than maxSize %d", minSize, maxSize)
 	}
-	concurrency := mustAtoi(os.Args[4])
+	concurrency := mustAtoi(args[3])
 
-	err := run(nFiles, minSize, maxSize, concurrency)
+	rec, err := stats.New(*csvPath, *warmup)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer rec.Close()
+
+	if err := run(nFiles, minSize, maxSize, concurrency, *codec, *dedup, *dupRatio, rec); err != nil {
+		log.Fatal(err)
+	}
 }
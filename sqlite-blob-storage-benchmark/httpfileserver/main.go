@@ -0,0 +1,291 @@
+// Command httpfileserver exposes the files table used by the crawshaw
+// benchmark over HTTP, with Range support, by streaming directly out of
+// SQLite BLOBs instead of loading whole files into memory.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// blobReadSeeker reads a crawshaw *sqlite.Blob through ReadAt at its own
+// offset, as an io.ReadSeeker, so http.ServeContent can drive Range and
+// multipart/byteranges handling for us while we stream straight out of the
+// BLOB, never buffering the whole row.
+type blobReadSeeker struct {
+	blob *sqlite.Blob
+	off  int64
+	size int64
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	n, err := b.blob.ReadAt(p, b.off)
+	b.off += int64(n)
+	if err == nil && b.off >= b.size && n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = b.off + offset
+	case io.SeekEnd:
+		next = b.size + offset
+	default:
+		return 0, fmt.Errorf("blobReadSeeker: invalid whence %d", whence)
+	}
+	if next < 0 {
+		return 0, fmt.Errorf("blobReadSeeker: negative position")
+	}
+	b.off = next
+	return b.off, nil
+}
+
+// fileServer serves the files table over HTTP.
+type fileServer struct {
+	dbPool *sqlitex.Pool
+}
+
+func (fs *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/files/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn := fs.dbPool.Get(r.Context())
+	if conn == nil {
+		http.Error(w, "no connection in pool available", http.StatusServiceUnavailable)
+		return
+	}
+	defer fs.dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`SELECT rowid AS row_id, length(data) AS size FROM files WHERE name = $name`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stmt.SetText("$name", name)
+	ok, err := stmt.Step()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rowID := stmt.GetInt64("row_id")
+	size := stmt.GetInt64("size")
+	if err := stmt.Reset(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	blob, err := conn.OpenBlob("", "files", "data", rowID, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%d"`, rowID, size))
+	http.ServeContent(w, r, name, time.Time{}, &blobReadSeeker{blob: blob, size: size})
+}
+
+func prepareDatabase(ctx context.Context, dbPool *sqlitex.Pool) error {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+	stmt, err := conn.Prepare(`CREATE TABLE IF NOT EXISTS files (name TEXT NOT NULL PRIMARY KEY, data BLOB);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Step()
+	if err != nil {
+		return fmt.Errorf("CREATE stmt.Step: %w", err)
+	}
+	return nil
+}
+
+func insertFile(ctx context.Context, dbPool *sqlitex.Pool, name string, data []byte) error {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`INSERT OR REPLACE INTO files (name, data) VALUES($name, $data);`)
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$name", name)
+	stmt.SetZeroBlob("$data", int64(len(data)))
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("INSERT stmt.Step: %w", err)
+	}
+	blob, err := conn.OpenBlob("", "files", "data", conn.LastInsertRowID(), true)
+	if err != nil {
+		return fmt.Errorf("conn.OpenBlob: %w", err)
+	}
+	defer blob.Close()
+	n, err := io.Copy(blob, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	if n != int64(len(data)) {
+		return fmt.Errorf("expected %d bytes to be written but was %d", len(data), n)
+	}
+	return nil
+}
+
+// selfTest fires overlapping Range requests at addr for name and checks that
+// every partial read matches the reference file byte-for-byte. It exists to
+// validate that pool connections are released promptly and that concurrent
+// range reads never interleave or corrupt each other.
+func selfTest(addr, name string, reference []byte, concurrency int) error {
+	var wg sync.WaitGroup
+	errCh := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := mrand.Int63n(int64(len(reference)))
+			length := mrand.Int63n(int64(len(reference)) - start + 1)
+			end := start + length - 1
+			if end < start {
+				end = start
+			}
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/files/%s", addr, name), nil)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusPartialContent {
+				errCh <- fmt.Errorf("worker %d: expected 206, got %d", i, resp.StatusCode)
+				return
+			}
+			got, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			want := reference[start : end+1]
+			if !bytes.Equal(got, want) {
+				errCh <- fmt.Errorf("worker %d: range %d-%d mismatch: got %d bytes, want %d bytes", i, start, end, len(got), len(want))
+				return
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func run(addr, dbPath string, selfTestConcurrency int) error {
+	dbPool, err := sqlitex.Open(dbPath, 0, 10)
+	if err != nil {
+		return fmt.Errorf("sqlitex.Open: %w", err)
+	}
+	defer dbPool.Close()
+
+	if err := prepareDatabase(context.TODO(), dbPool); err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: addr, Handler: &fileServer{dbPool: dbPool}}
+
+	if selfTestConcurrency > 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(1<<20))
+		if err != nil {
+			return err
+		}
+		size := int(n.Int64()) + 1<<20
+		data, err := randomBytes(size)
+		if err != nil {
+			return err
+		}
+		const testFile = "selftest.bin"
+		if err := insertFile(context.TODO(), dbPool, testFile, data); err != nil {
+			return err
+		}
+
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		go srv.Serve(ln)
+		defer srv.Close()
+
+		if err := selfTest(ln.Addr().String(), testFile, data, selfTestConcurrency); err != nil {
+			return fmt.Errorf("self-test failed: %w", err)
+		}
+		log.Println("self-test ok:", selfTestConcurrency, "concurrent range requests")
+		return nil
+	}
+
+	log.Println("listening on:", addr)
+	return srv.ListenAndServe()
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dbPath := flag.String("db", "files.db", "path to the sqlite database holding the files table")
+	selfTestConcurrency := flag.Int("self-test", 0, "if > 0, run N concurrent overlapping range requests against an in-process server and exit instead of serving forever")
+	flag.Parse()
+
+	if err := run(*addr, *dbPath, *selfTestConcurrency); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,99 +17,231 @@ import (
 	"strconv"
 	"time"
 
+	codecpool "github.com/klingtnet/playground/sqlite-blob-storage-benchmark/codec"
+	"github.com/klingtnet/playground/sqlite-blob-storage-benchmark/corpus"
+	"github.com/klingtnet/playground/sqlite-blob-storage-benchmark/stats"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func prepareFiles(dir string, nFiles, minSize, maxSize int) error {
-	for i := 0; i < nFiles; i++ {
-		size := minSize + rand.Intn(maxSize-minSize)
-		fName := fmt.Sprintf("%d.bin", i)
-		f, err := os.OpenFile(filepath.Join(dir, fName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
+const (
+	codecNone     = "none"
+	codecZstd     = "zstd"
+	codecZstdDict = "zstd-dict"
+)
 
-		// write in chunks of 8M to save RAM
-		chunkSize := 8 * 1024 * 1024
-		chunk := make([]byte, chunkSize)
-		for size > 0 {
-			n := chunkSize
-			if size < chunkSize {
-				n = size
-			}
-			_, err = rand.Read(chunk[:n])
-			if err != nil {
-				return err
-			}
-			size -= n
-			_, err = f.Write(chunk[:n])
-			if err != nil {
-				return err
-			}
-		}
-		fmt.Println("created testfile:", f.Name())
+func storeDict(db *sql.DB, dict []byte) error {
+	_, err := db.ExecContext(context.TODO(), `CREATE TABLE codec_meta (name TEXT NOT NULL PRIMARY KEY, dict BLOB)`)
+	if err != nil {
+		return err
 	}
-	return nil
+	_, err = db.ExecContext(context.TODO(), `INSERT INTO codec_meta VALUES(?, ?)`, codecZstdDict, dict)
+	return err
+}
+
+func loadDict(db *sql.DB) ([]byte, error) {
+	row := db.QueryRowContext(context.TODO(), `SELECT dict FROM codec_meta WHERE name = ?`, codecZstdDict)
+	var dict []byte
+	if err := row.Scan(&dict); err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
+
+// fileStats reports, for a single insert/select, the original byte count
+// and the time spent in the codec, separate from the time spent doing
+// SQLite I/O. storedBytes is set on the insert side only.
+type fileStats struct {
+	origBytes   int64
+	storedBytes int64
+	codecDur    time.Duration
+}
+
+func encode(pool *codecpool.Pool, data []byte) ([]byte, time.Duration, error) {
+	enc := pool.GetEncoder()
+	defer pool.PutEncoder(enc)
+	start := time.Now()
+	out := enc.EncodeAll(data, nil)
+	return out, time.Since(start), nil
+}
+
+func decode(pool *codecpool.Pool, data []byte) ([]byte, time.Duration, error) {
+	dec := pool.GetDecoder()
+	defer pool.PutDecoder(dec)
+	start := time.Now()
+	out, err := dec.DecodeAll(data, nil)
+	return out, time.Since(start), err
 }
 
-func prepareDatabase(db *sql.DB, dir string, nFiles int) error {
+func prepareDatabase(db *sql.DB, dir string, nFiles int, codec string, pool *codecpool.Pool) (fileStats, error) {
 	_, err := db.ExecContext(context.TODO(), `CREATE TABLE files (name TEXT NOT NULL PRIMARY KEY, data BLOB)`)
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	tFiles, err := filepath.Glob(dir + "/*.bin")
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	if len(tFiles) != nFiles {
-		return fmt.Errorf("expected %d test files but was %d", nFiles, len(tFiles))
+		return fileStats{}, fmt.Errorf("expected %d test files but was %d", nFiles, len(tFiles))
 	}
+	var total fileStats
 	for _, tFile := range tFiles {
 		data, err := ioutil.ReadFile(tFile)
 		if err != nil {
-			return err
+			return fileStats{}, err
 		}
-		_, err = db.ExecContext(context.TODO(), `INSERT INTO files VALUES(?, ?)`, filepath.Base(tFile), data)
+		stored := data
+		var codecDur time.Duration
+		if codec != codecNone {
+			stored, codecDur, err = encode(pool, data)
+			if err != nil {
+				return fileStats{}, fmt.Errorf("zstd encode: %w", err)
+			}
+		}
+		_, err = db.ExecContext(context.TODO(), `INSERT INTO files VALUES(?, ?)`, filepath.Base(tFile), stored)
 		if err != nil {
-			return err
+			return fileStats{}, err
 		}
+		total.origBytes += int64(len(data))
+		total.storedBytes += int64(len(stored))
+		total.codecDur += codecDur
 		fmt.Printf("stored %s in database\n", tFile)
 	}
 
-	return nil
+	return total, nil
 }
 
-func selectFile(ctx context.Context, db *sql.DB, filename string) error {
+func selectFile(ctx context.Context, db *sql.DB, filename, codec string, pool *codecpool.Pool) (fileStats, error) {
 	row := db.QueryRowContext(ctx, "SELECT data FROM files WHERE name = ?", filename)
 	var data []byte
 	err := row.Scan(&data)
 	if err != nil {
-		return err
+		return fileStats{}, err
 	}
 	if len(data) == 0 {
-		return fmt.Errorf("sqlite: empty file %s", filename)
+		return fileStats{}, fmt.Errorf("sqlite: empty file %s", filename)
 	}
-	return nil
+	var codecDur time.Duration
+	n := int64(len(data))
+	if codec != codecNone {
+		decoded, dur, err := decode(pool, data)
+		if err != nil {
+			return fileStats{}, fmt.Errorf("zstd decode: %w", err)
+		}
+		codecDur = dur
+		n = int64(len(decoded))
+	}
+	return fileStats{origBytes: n, codecDur: codecDur}, nil
+}
+
+func prepareDatabaseDedup(db *sql.DB, dir string, nFiles int) (stats.DedupReport, error) {
+	_, err := db.ExecContext(context.TODO(), `CREATE TABLE blobs (hash TEXT NOT NULL PRIMARY KEY, size INT NOT NULL, data BLOB NOT NULL)`)
+	if err != nil {
+		return stats.DedupReport{}, err
+	}
+	_, err = db.ExecContext(context.TODO(), `CREATE TABLE files (name TEXT NOT NULL PRIMARY KEY, hash TEXT NOT NULL REFERENCES blobs(hash))`)
+	if err != nil {
+		return stats.DedupReport{}, err
+	}
+
+	tFiles, err := filepath.Glob(dir + "/*.bin")
+	if err != nil {
+		return stats.DedupReport{}, err
+	}
+	if len(tFiles) != nFiles {
+		return stats.DedupReport{}, fmt.Errorf("expected %d test files but was %d", nFiles, len(tFiles))
+	}
+
+	var report stats.DedupReport
+	for _, tFile := range tFiles {
+		deduped, size, err := insertFileDedup(db, tFile)
+		if err != nil {
+			return stats.DedupReport{}, err
+		}
+		report.Files++
+		report.OrigBytes += size
+		if deduped {
+			report.DedupedFiles++
+		}
+		fmt.Printf("stored %s in database\n", tFile)
+	}
+
+	row := db.QueryRowContext(context.TODO(), `SELECT COALESCE(SUM(size), 0) FROM blobs`)
+	if err := row.Scan(&report.StoredBytes); err != nil {
+		return stats.DedupReport{}, err
+	}
+
+	return report, nil
+}
+
+// insertFileDedup hashes tFile's content while streaming it into a buffer
+// (io.TeeReader feeds both the buffer and the sha256 hasher), then either
+// points files at an existing blob with that hash or inserts a new one.
+func insertFileDedup(db *sql.DB, tFile string) (deduped bool, size int64, err error) {
+	f, err := os.Open(tFile)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.TeeReader(f, hasher))
+	if err != nil {
+		return false, 0, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	row := db.QueryRowContext(context.TODO(), `SELECT 1 FROM blobs WHERE hash = ?`, hash)
+	var exists int
+	switch err := row.Scan(&exists); err {
+	case nil:
+		deduped = true
+	case sql.ErrNoRows:
+		_, err = db.ExecContext(context.TODO(), `INSERT INTO blobs VALUES(?, ?, ?)`, hash, n, buf.Bytes())
+		if err != nil {
+			return false, 0, err
+		}
+	default:
+		return false, 0, err
+	}
+
+	_, err = db.ExecContext(context.TODO(), `INSERT INTO files VALUES(?, ?)`, filepath.Base(tFile), hash)
+	if err != nil {
+		return false, 0, err
+	}
+	return deduped, n, nil
 }
 
-func readFile(filename string) error {
+func selectFileDedup(ctx context.Context, db *sql.DB, filename string) (int64, error) {
+	row := db.QueryRowContext(ctx, `SELECT blobs.data FROM files JOIN blobs ON files.hash = blobs.hash WHERE files.name = ?`, filename)
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, fmt.Errorf("sqlite: empty file %s", filename)
+	}
+	return int64(len(data)), nil
+}
+
+func readFile(filename string) (int64, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer f.Close()
 	n, err := io.Copy(ioutil.Discard, f)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if n == 0 {
-		return fmt.Errorf("empty file %s", f.Name())
+		return 0, fmt.Errorf("empty file %s", f.Name())
 	}
-	return nil
+	return n, nil
 }
 
-func run(nFiles, minSize, maxSize, concurrency int) error {
+func run(nFiles, minSize, maxSize, concurrency int, codec string, dedup bool, dupRatio float64, rec *stats.Recorder) error {
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -132,7 +268,7 @@ func run(nFiles, minSize, maxSize, concurrency int) error {
 	}()
 
 	rand.Seed(time.Now().UnixNano())
-	err = prepareFiles(tDir, nFiles, minSize, maxSize)
+	err = corpus.Generate(tDir, nFiles, minSize, maxSize, dupRatio)
 	if err != nil {
 		return err
 	}
@@ -142,36 +278,64 @@ func run(nFiles, minSize, maxSize, concurrency int) error {
 		return err
 	}
 	defer db.Close()
-	err = prepareDatabase(db, tDir, nFiles)
+
+	if dedup {
+		return runDedup(db, tDir, nFiles, concurrency, rec)
+	}
+
+	var pool *codecpool.Pool
+	if codec != codecNone {
+		var dict []byte
+		if codec == codecZstdDict {
+			dict, err = codecpool.TrainDict(tDir, codecpool.SampleFiles)
+			if err != nil {
+				return fmt.Errorf("codecpool.TrainDict: %w", err)
+			}
+			if err := storeDict(db, dict); err != nil {
+				return fmt.Errorf("storeDict: %w", err)
+			}
+			dict, err = loadDict(db)
+			if err != nil {
+				return fmt.Errorf("loadDict: %w", err)
+			}
+		}
+		pool, err = codecpool.NewPool(concurrency, dict)
+		if err != nil {
+			return fmt.Errorf("codecpool.NewPool: %w", err)
+		}
+		defer pool.Close()
+	}
+
+	insertStats, err := prepareDatabase(db, tDir, nFiles, codec, pool)
 	if err != nil {
 		return err
 	}
 
-	resultCh := make(chan time.Duration)
 	errCh := make(chan error)
 	doneCh := make(chan interface{})
 
 	for i := 0; i < concurrency; i++ {
-		go func() {
+		go func(workerID int) {
 			for j := 0; j < nFiles; j++ {
-				start := time.Now()
 				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
 
-				err = readFile(filepath.Join(tDir, filename))
+				n, err := readFile(filepath.Join(tDir, filename))
 				if err != nil {
 					errCh <- err
+					return
+				}
+				if err := rec.Record("files", workerID, j, filename, n, time.Since(start)); err != nil {
+					errCh <- err
+					return
 				}
-				resultCh <- time.Since(start)
 			}
 			doneCh <- nil
-		}()
+		}(i)
 	}
 	routinesRunning := concurrency
-	var fileTimes []time.Duration
 	for routinesRunning > 0 {
 		select {
-		case t := <-resultCh:
-			fileTimes = append(fileTimes, t)
 		case <-doneCh:
 			routinesRunning--
 		case err := <-errCh:
@@ -179,49 +343,158 @@ func run(nFiles, minSize, maxSize, concurrency int) error {
 		}
 	}
 
+	statsCh := make(chan fileStats)
 	for i := 0; i < concurrency; i++ {
-		go func() {
+		go func(workerID int) {
 			for j := 0; j < nFiles; j++ {
-				start := time.Now()
 				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
 
-				err = selectFile(context.TODO(), db, filename)
+				s, err := selectFile(context.TODO(), db, filename, codec, pool)
 				if err != nil {
 					errCh <- err
+					return
 				}
-				resultCh <- time.Since(start)
+				if err := rec.Record("sql", workerID, j, filename, s.origBytes, time.Since(start)); err != nil {
+					errCh <- err
+					return
+				}
+				statsCh <- s
 			}
 			doneCh <- nil
-		}()
+		}(i)
 	}
 	routinesRunning = concurrency
-	var sqlTimes []time.Duration
+	var selectStats []fileStats
+	for routinesRunning > 0 {
+		select {
+		case s := <-statsCh:
+			selectStats = append(selectStats, s)
+		case <-doneCh:
+			routinesRunning--
+		case err := <-errCh:
+			return err
+		}
+	}
+
+	var totalSelectCodec time.Duration
+	var totalDecoded int64
+	for _, s := range selectStats {
+		totalDecoded += s.origBytes
+		totalSelectCodec += s.codecDur
+	}
+
+	rec.Report(os.Stdout, "files")
+	rec.Report(os.Stdout, "sql")
+	if codec != codecNone {
+		ratio := float64(insertStats.storedBytes) / float64(insertStats.origBytes)
+		fmt.Printf("codec: %s\toriginal bytes: %d\tstored bytes: %d\tratio: %.3f\n",
+			codec, insertStats.origBytes, insertStats.storedBytes, ratio)
+		fmt.Printf("codec: encode time: %s\tdecode time: %s\tdecoded bytes: %d\n",
+			insertStats.codecDur, totalSelectCodec, totalDecoded)
+	}
+
+	return nil
+}
+
+// runDedup is the --dedup counterpart of run: it uses the content-addressable
+// blobs/files schema instead of the plain files table, and reports the
+// dedup ratio and space saved alongside the usual files:/sql: latency
+// summaries.
+func runDedup(db *sql.DB, tDir string, nFiles, concurrency int, rec *stats.Recorder) error {
+	report, err := prepareDatabaseDedup(db, tDir, nFiles)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error)
+	doneCh := make(chan interface{})
+
+	for i := 0; i < concurrency; i++ {
+		go func(workerID int) {
+			for j := 0; j < nFiles; j++ {
+				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
+
+				n, err := readFile(filepath.Join(tDir, filename))
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if err := rec.Record("files", workerID, j, filename, n, time.Since(start)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			doneCh <- nil
+		}(i)
+	}
+	routinesRunning := concurrency
 	for routinesRunning > 0 {
 		select {
-		case t := <-resultCh:
-			sqlTimes = append(sqlTimes, t)
 		case <-doneCh:
 			routinesRunning--
 		case err := <-errCh:
 			return err
 		}
 	}
-	var totalFiles time.Duration
-	for _, v := range fileTimes {
-		totalFiles += v
+
+	for i := 0; i < concurrency; i++ {
+		go func(workerID int) {
+			for j := 0; j < nFiles; j++ {
+				filename := fmt.Sprintf("%d.bin", j%nFiles)
+				start := time.Now()
+
+				size, err := selectFileDedup(context.TODO(), db, filename)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if err := rec.Record("sql", workerID, j, filename, size, time.Since(start)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			doneCh <- nil
+		}(i)
 	}
-	var totalSQL time.Duration
-	for _, v := range sqlTimes {
-		totalSQL += v
+	routinesRunning = concurrency
+	for routinesRunning > 0 {
+		select {
+		case <-doneCh:
+			routinesRunning--
+		case err := <-errCh:
+			return err
+		}
 	}
-	fmt.Printf("total: files: %s\tsql: %s\n", totalFiles, totalSQL)
+
+	rec.Report(os.Stdout, "files")
+	rec.Report(os.Stdout, "sql")
+	report.Report(os.Stdout)
 
 	return nil
 }
 
 func main() {
-	if len(os.Args) != 5 {
-		log.Fatalf("USAGE: %s <nr-of-files> <min-size> <max-size> <concurrency>", os.Args[0])
+	codec := flag.String("codec", codecNone, "blob codec to use for inserts/selects: none, zstd, zstd-dict")
+	dedup := flag.Bool("dedup", false, "store files content-addressed by sha256 hash instead of by name, deduplicating identical content")
+	dupRatio := flag.Float64("dup-ratio", 0, "fraction (0-1) of generated test files that are exact duplicates of an earlier file; only affects test data generation")
+	csvPath := flag.String("csv", "", "if set, stream per-sample (worker,iteration,mode,filename,size,duration_ns) rows to this CSV file")
+	warmup := flag.Int("warmup", 0, "number of leading iterations per worker to discard from the histogram and CSV trace")
+	flag.Parse()
+
+	switch *codec {
+	case codecNone, codecZstd, codecZstdDict:
+	default:
+		log.Fatalf("unknown --codec %q, must be one of none, zstd, zstd-dict", *codec)
+	}
+	if *dedup && *codec != codecNone {
+		log.Fatal("--dedup cannot be combined with --codec")
+	}
+
+	args := flag.Args()
+	if len(args) != 4 {
+		log.Fatalf("USAGE: %s [--codec none|zstd|zstd-dict] [--dedup] [--dup-ratio 0.0-1.0] [--csv path.csv] [--warmup N] <nr-of-files> <min-size> <max-size> <concurrency>", os.Args[0])
 	}
 	mustAtoi := func(s string) int {
 		i, err := strconv.Atoi(s)
@@ -230,15 +503,20 @@ func main() {
 		}
 		return i
 	}
-	nFiles := mustAtoi(os.Args[1])
-	minSize, maxSize := mustAtoi(os.Args[2]), mustAtoi(os.Args[3])
+	nFiles := mustAtoi(args[0])
+	minSize, maxSize := mustAtoi(args[1]), mustAtoi(args[2])
 	if minSize >= maxSize {
 		log.Fatalf("minSize %d must be less than maxSize %d", minSize, maxSize)
 	}
-	concurrency := mustAtoi(os.Args[4])
+	concurrency := mustAtoi(args[3])
 
-	err := run(nFiles, minSize, maxSize, concurrency)
+	rec, err := stats.New(*csvPath, *warmup)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer rec.Close()
+
+	if err := run(nFiles, minSize, maxSize, concurrency, *codec, *dedup, *dupRatio, rec); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,145 @@
+// Package stats provides the report types shared by the crawshaw and mattn
+// SQLite BLOB benchmarks, so their output is directly comparable: a
+// log-linear latency histogram per mode (e.g. "files" vs "sql") plus an
+// optional per-sample CSV trace, and a summary for --dedup runs.
+package stats
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+const (
+	minValue           = 1
+	maxValue           = int64(10 * time.Minute)
+	significantFigures = 3
+)
+
+// Recorder accumulates per-file durations into one histogram per mode and,
+// if configured with a CSV path, streams every sample to disk for offline
+// analysis. The first warmup iterations of each worker are discarded
+// entirely, from both the histogram and the CSV trace.
+type Recorder struct {
+	mu      sync.Mutex
+	hists   map[string]*hdrhistogram.Histogram
+	csvW    *csv.Writer
+	csvFile *os.File
+	warmup  int
+}
+
+// New creates a Recorder. If csvPath is empty, no CSV trace is written.
+func New(csvPath string, warmup int) (*Recorder, error) {
+	r := &Recorder{
+		hists:  make(map[string]*hdrhistogram.Histogram),
+		warmup: warmup,
+	}
+	if csvPath == "" {
+		return r, nil
+	}
+	f, err := os.Create(csvPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating csv trace file: %w", err)
+	}
+	r.csvFile = f
+	r.csvW = csv.NewWriter(f)
+	if err := r.csvW.Write([]string{"worker", "iteration", "mode", "filename", "size", "duration_ns"}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing csv header: %w", err)
+	}
+	return r, nil
+}
+
+// Record adds one (worker, iteration) sample for mode. Samples with
+// iteration < warmup are dropped.
+func (r *Recorder) Record(mode string, worker, iteration int, filename string, size int64, dur time.Duration) error {
+	if iteration < r.warmup {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.hists[mode]
+	if !ok {
+		h = hdrhistogram.New(minValue, maxValue, significantFigures)
+		r.hists[mode] = h
+	}
+	if err := h.RecordValue(dur.Nanoseconds()); err != nil {
+		return fmt.Errorf("recording %s latency: %w", mode, err)
+	}
+
+	if r.csvW == nil {
+		return nil
+	}
+	return r.csvW.Write([]string{
+		strconv.Itoa(worker),
+		strconv.Itoa(iteration),
+		mode,
+		filename,
+		strconv.FormatInt(size, 10),
+		strconv.FormatInt(dur.Nanoseconds(), 10),
+	})
+}
+
+// Close flushes the CSV trace, if any, and closes its file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.csvW == nil {
+		return nil
+	}
+	r.csvW.Flush()
+	if err := r.csvW.Error(); err != nil {
+		return err
+	}
+	return r.csvFile.Close()
+}
+
+// Report writes a one-line summary of mode's latency distribution to w.
+func (r *Recorder) Report(w io.Writer, mode string) {
+	r.mu.Lock()
+	h := r.hists[mode]
+	r.mu.Unlock()
+
+	if h == nil || h.TotalCount() == 0 {
+		fmt.Fprintf(w, "%s: no samples recorded\n", mode)
+		return
+	}
+	fmt.Fprintf(w, "%s: n=%d min=%s mean=%s p50=%s p90=%s p95=%s p99=%s p99.9=%s max=%s\n",
+		mode,
+		h.TotalCount(),
+		time.Duration(h.Min()),
+		time.Duration(int64(h.Mean())),
+		time.Duration(h.ValueAtQuantile(50)),
+		time.Duration(h.ValueAtQuantile(90)),
+		time.Duration(h.ValueAtQuantile(95)),
+		time.Duration(h.ValueAtQuantile(99)),
+		time.Duration(h.ValueAtQuantile(99.9)),
+		time.Duration(h.Max()),
+	)
+}
+
+// DedupReport summarizes a whole --dedup run: how many files were stored,
+// how many of those were dedup hits, and how many bytes actually landed in
+// the blobs table vs. the sum of original file sizes.
+type DedupReport struct {
+	Files        int
+	DedupedFiles int
+	OrigBytes    int64
+	StoredBytes  int64
+}
+
+// Report writes a one-line summary of the dedup run to w.
+func (r DedupReport) Report(w io.Writer) {
+	ratio := float64(r.DedupedFiles) / float64(r.Files)
+	spaceSaved := r.OrigBytes - r.StoredBytes
+	fmt.Fprintf(w, "dedup: files: %d\tdeduped: %d\tratio: %.3f\toriginal bytes: %d\tstored bytes: %d\tspace saved: %d\n",
+		r.Files, r.DedupedFiles, ratio, r.OrigBytes, r.StoredBytes, spaceSaved)
+}
@@ -0,0 +1,663 @@
+// Command cmd_webdav mounts the files table used by the crawshaw benchmark
+// as a read/write WebDAV filesystem, guarded by HTTP basic auth.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+)
+
+// authConfig is the on-disk basic-auth config: a single user and a bcrypt
+// hash of their password.
+type authConfig struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
+
+func loadAuthConfig(path string) (*authConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg authConfig
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func basicAuth(cfg *authConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(cfg.Username)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="webdav"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(cfg.PasswordHash), []byte(pass)); err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="webdav"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// copyMiddleware intercepts COPY requests whose source is a virtual
+// directory and duplicates its rows via sqliteFS.copyDir, inside one
+// transaction. Single-file copies fall through to next unchanged: the
+// library's generic copyFiles path is already atomic for a single row.
+func copyMiddleware(fs *sqliteFS, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "COPY" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		src := clean(r.URL.Path)
+		isDir, err := fs.hasPrefix(ctx, src)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !isDir {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		destHeader := r.Header.Get("Destination")
+		if destHeader == "" {
+			http.Error(w, "missing Destination header", http.StatusBadRequest)
+			return
+		}
+		destURL, err := url.Parse(destHeader)
+		if err != nil {
+			http.Error(w, "invalid Destination header", http.StatusBadRequest)
+			return
+		}
+		dst := clean(destURL.Path)
+
+		if r.Header.Get("Overwrite") == "F" {
+			if _, _, ok, err := fs.rowExists(ctx, dst); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if ok {
+				http.Error(w, "destination exists", http.StatusPreconditionFailed)
+				return
+			}
+		}
+
+		if err := fs.copyDir(ctx, src, dst); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+func prepareDatabase(ctx context.Context, dbPool *sqlitex.Pool) error {
+	conn := dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer dbPool.Put(conn)
+	stmt, err := conn.Prepare(`CREATE TABLE IF NOT EXISTS files (name TEXT NOT NULL PRIMARY KEY, data BLOB);`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Step()
+	if err != nil {
+		return fmt.Errorf("CREATE stmt.Step: %w", err)
+	}
+	return nil
+}
+
+// sqliteFS implements webdav.FileSystem over the files table, treating '/'
+// in a row's name as a virtual directory hierarchy: there are no directory
+// rows, a "directory" is just a name prefix shared by one or more files.
+type sqliteFS struct {
+	dbPool *sqlitex.Pool
+}
+
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (fs *sqliteFS) rowExists(ctx context.Context, name string) (rowID int64, size int64, ok bool, err error) {
+	conn := fs.dbPool.Get(ctx)
+	if conn == nil {
+		return 0, 0, false, fmt.Errorf("no connection in pool available")
+	}
+	defer fs.dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`SELECT rowid AS row_id, length(data) AS size FROM files WHERE name = $name`)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	stmt.SetText("$name", name)
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if !hasRow {
+		return 0, 0, false, nil
+	}
+	rowID, size = stmt.GetInt64("row_id"), stmt.GetInt64("size")
+	if err := stmt.Reset(); err != nil {
+		return 0, 0, false, err
+	}
+	return rowID, size, true, nil
+}
+
+// hasPrefix reports whether any row's name starts with name+"/", i.e.
+// whether name is a virtual directory.
+func (fs *sqliteFS) hasPrefix(ctx context.Context, name string) (bool, error) {
+	conn := fs.dbPool.Get(ctx)
+	if conn == nil {
+		return false, fmt.Errorf("no connection in pool available")
+	}
+	defer fs.dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`SELECT 1 FROM files WHERE name LIKE $like LIMIT 1`)
+	if err != nil {
+		return false, err
+	}
+	stmt.SetText("$like", name+"/%")
+	ok, err := stmt.Step()
+	if err != nil {
+		return false, err
+	}
+	if err := stmt.Reset(); err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (fs *sqliteFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	// Directories are purely virtual: a Mkdir for a name with no rows under
+	// it yet has nothing to persist.
+	return nil
+}
+
+func (fs *sqliteFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = clean(name)
+	if name == "" {
+		return &sqliteDir{fs: fs, name: ""}, nil
+	}
+
+	rowID, size, ok, err := fs.rowExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return newSqliteWriteFile(fs, name), nil
+		}
+		return &sqliteReadFile{fs: fs, name: name, rowID: rowID, size: size}, nil
+	}
+
+	isDir, err := fs.hasPrefix(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		return &sqliteDir{fs: fs, name: name}, nil
+	}
+	if flag&os.O_CREATE != 0 {
+		return newSqliteWriteFile(fs, name), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fs *sqliteFS) RemoveAll(ctx context.Context, name string) error {
+	name = clean(name)
+	conn := fs.dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer fs.dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`DELETE FROM files WHERE name = $name OR name LIKE $like`)
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$name", name)
+	stmt.SetText("$like", name+"/%")
+	_, err = stmt.Step()
+	return err
+}
+
+// Rename renames a single row, but also handles "directory" renames: since
+// directories are virtual (a shared name prefix, see hasPrefix/Readdir),
+// moving one means rewriting every row whose name starts with oldName+"/"
+// to the same relative path under newName, same prefix pattern RemoveAll
+// uses. Both updates run in one transaction so a MOVE is all-or-nothing.
+func (fs *sqliteFS) Rename(ctx context.Context, oldName, newName string) (err error) {
+	oldName, newName = clean(oldName), clean(newName)
+	conn := fs.dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer fs.dbPool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+
+	stmt, err := conn.Prepare(`UPDATE files SET name = $new WHERE name = $old`)
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$new", newName)
+	stmt.SetText("$old", oldName)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+
+	childStmt, err := conn.Prepare(`UPDATE files SET name = $new || substr(name, length($old) + 1) WHERE name LIKE $like`)
+	if err != nil {
+		return err
+	}
+	childStmt.SetText("$new", newName)
+	childStmt.SetText("$old", oldName)
+	childStmt.SetText("$like", oldName+"/%")
+	_, err = childStmt.Step()
+	return err
+}
+
+// copyDir duplicates every row under the src prefix (including src itself,
+// if it is also a file) to the same relative path under dst, in one
+// transaction, so a COPY of a virtual directory with several files can't
+// partially succeed the way golang.org/x/net/webdav's generic per-file
+// copyFiles could.
+func (fs *sqliteFS) copyDir(ctx context.Context, src, dst string) (err error) {
+	conn := fs.dbPool.Get(ctx)
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer fs.dbPool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+
+	stmt, err := conn.Prepare(`
+		INSERT INTO files (name, data)
+		SELECT $dst || substr(name, length($src) + 1), data FROM files WHERE name = $src OR name LIKE $like
+		ON CONFLICT(name) DO UPDATE SET data = excluded.data`)
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$dst", dst)
+	stmt.SetText("$src", src)
+	stmt.SetText("$like", src+"/%")
+	_, err = stmt.Step()
+	return err
+}
+
+func (fs *sqliteFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = clean(name)
+	if name == "" {
+		return &fileInfo{name: "/", isDir: true}, nil
+	}
+	_, size, ok, err := fs.rowExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &fileInfo{name: path.Base(name), size: size}, nil
+	}
+	isDir, err := fs.hasPrefix(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		return &fileInfo{name: path.Base(name), isDir: true}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// fileInfo is a minimal os.FileInfo backed by the files table or a virtual
+// directory prefix.
+type fileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (fi *fileInfo) Name() string { return fi.name }
+func (fi *fileInfo) Size() int64  { return fi.size }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool        { return fi.isDir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// sqliteReadFile streams a row's BLOB straight out of SQLite via OpenBlob,
+// the same incremental blob handle the crawshaw benchmark's insertFile
+// writes through, so GET never buffers the whole file.
+type sqliteReadFile struct {
+	fs    *sqliteFS
+	name  string
+	rowID int64
+	size  int64
+
+	conn *sqlite.Conn
+	blob *sqlite.Blob
+	off  int64
+}
+
+func (f *sqliteReadFile) ensureOpen() error {
+	if f.blob != nil {
+		return nil
+	}
+	conn := f.fs.dbPool.Get(context.TODO())
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	// sqlite3_blob_open doesn't lazily load the schema the way Prepare does,
+	// so a freshly pooled connection that has never run a statement needs a
+	// cheap warm-up query before the files table is visible to it.
+	if _, err := conn.Prep("SELECT 1").Step(); err != nil {
+		f.fs.dbPool.Put(conn)
+		return err
+	}
+	blob, err := conn.OpenBlob("", "files", "data", f.rowID, false)
+	if err != nil {
+		f.fs.dbPool.Put(conn)
+		return err
+	}
+	f.conn, f.blob = conn, blob
+	return nil
+}
+
+func (f *sqliteReadFile) Read(p []byte) (int, error) {
+	if err := f.ensureOpen(); err != nil {
+		return 0, err
+	}
+	if f.off >= f.size {
+		return 0, io.EOF
+	}
+	n, err := f.blob.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *sqliteReadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.off = offset
+	case io.SeekCurrent:
+		f.off += offset
+	case io.SeekEnd:
+		f.off = f.size + offset
+	}
+	return f.off, nil
+}
+
+func (f *sqliteReadFile) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("sqliteReadFile: read-only")
+}
+
+func (f *sqliteReadFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("sqliteReadFile: not a directory")
+}
+
+func (f *sqliteReadFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(f.name), size: f.size}, nil
+}
+
+func (f *sqliteReadFile) Close() error {
+	if f.blob != nil {
+		f.blob.Close()
+	}
+	if f.conn != nil {
+		f.fs.dbPool.Put(f.conn)
+	}
+	return nil
+}
+
+// sqliteDir implements webdav.File for a virtual directory: a name that is
+// either the root or a prefix shared by one or more file rows.
+type sqliteDir struct {
+	fs   *sqliteFS
+	name string
+}
+
+func (d *sqliteDir) Read(p []byte) (int, error)  { return 0, fmt.Errorf("sqliteDir: is a directory") }
+func (d *sqliteDir) Write(p []byte) (int, error) { return 0, fmt.Errorf("sqliteDir: is a directory") }
+func (d *sqliteDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, fmt.Errorf("sqliteDir: is a directory")
+}
+func (d *sqliteDir) Close() error { return nil }
+func (d *sqliteDir) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(d.name), isDir: true}, nil
+}
+
+func (d *sqliteDir) Readdir(count int) ([]os.FileInfo, error) {
+	conn := d.fs.dbPool.Get(context.TODO())
+	if conn == nil {
+		return nil, fmt.Errorf("no connection in pool available")
+	}
+	defer d.fs.dbPool.Put(conn)
+
+	prefix := d.name
+	like := "%"
+	if prefix != "" {
+		like = prefix + "/%"
+	}
+	stmt, err := conn.Prepare(`SELECT name, length(data) AS size FROM files WHERE name LIKE $like`)
+	if err != nil {
+		return nil, err
+	}
+	stmt.SetText("$like", like)
+
+	seen := map[string]*fileInfo{}
+	for {
+		ok, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		full := stmt.GetText("name")
+		rest := full
+		if prefix != "" {
+			rest = strings.TrimPrefix(full, prefix+"/")
+		}
+		if idx := strings.Index(rest, "/"); idx >= 0 {
+			child := rest[:idx]
+			if _, ok := seen[child]; !ok {
+				seen[child] = &fileInfo{name: child, isDir: true}
+			}
+		} else {
+			seen[rest] = &fileInfo{name: rest, size: stmt.GetInt64("size")}
+		}
+	}
+
+	var entries []os.FileInfo
+	for _, fi := range seen {
+		entries = append(entries, fi)
+	}
+	return entries, nil
+}
+
+// sqliteWriteFile spools writes to a temp file and, on Close, performs the
+// same SetZeroBlob+io.Copy pattern insertFile uses: the final size has to be
+// known before a zero-blob can be allocated, so we buffer to disk (never to
+// memory) and stream into SQLite once the upload is complete.
+type sqliteWriteFile struct {
+	fs   *sqliteFS
+	name string
+	tmp  *os.File
+}
+
+func newSqliteWriteFile(fs *sqliteFS, name string) *sqliteWriteFile {
+	return &sqliteWriteFile{fs: fs, name: name}
+}
+
+func (f *sqliteWriteFile) ensureTmp() error {
+	if f.tmp != nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp("", "webdav-put-*")
+	if err != nil {
+		return err
+	}
+	f.tmp = tmp
+	return nil
+}
+
+func (f *sqliteWriteFile) Write(p []byte) (int, error) {
+	if err := f.ensureTmp(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Write(p)
+}
+
+func (f *sqliteWriteFile) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("sqliteWriteFile: write-only")
+}
+
+func (f *sqliteWriteFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.ensureTmp(); err != nil {
+		return 0, err
+	}
+	return f.tmp.Seek(offset, whence)
+}
+
+func (f *sqliteWriteFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("sqliteWriteFile: not a directory")
+}
+
+func (f *sqliteWriteFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(f.name)}, nil
+}
+
+func (f *sqliteWriteFile) Close() error {
+	if f.tmp == nil {
+		// Zero-byte PUT: still create the row.
+		return f.commit(nil, 0)
+	}
+	defer os.Remove(f.tmp.Name())
+	defer f.tmp.Close()
+
+	info, err := f.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return f.commit(f.tmp, info.Size())
+}
+
+func (f *sqliteWriteFile) commit(src io.Reader, size int64) error {
+	conn := f.fs.dbPool.Get(context.TODO())
+	if conn == nil {
+		return fmt.Errorf("no connection in pool available")
+	}
+	defer f.fs.dbPool.Put(conn)
+
+	stmt, err := conn.Prepare(`INSERT INTO files (name, data) VALUES($name, $data)
+		ON CONFLICT(name) DO UPDATE SET data = excluded.data;`)
+	if err != nil {
+		return err
+	}
+	stmt.SetText("$name", f.name)
+	stmt.SetZeroBlob("$data", size)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("INSERT stmt.Step: %w", err)
+	}
+	if size == 0 {
+		return nil
+	}
+
+	rowStmt, err := conn.Prepare(`SELECT rowid AS row_id FROM files WHERE name = $name`)
+	if err != nil {
+		return err
+	}
+	rowStmt.SetText("$name", f.name)
+	ok, err := rowStmt.Step()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("row for %s vanished after insert", f.name)
+	}
+	rowID := rowStmt.GetInt64("row_id")
+	if err := rowStmt.Reset(); err != nil {
+		return err
+	}
+
+	blob, err := conn.OpenBlob("", "files", "data", rowID, true)
+	if err != nil {
+		return fmt.Errorf("conn.OpenBlob: %w", err)
+	}
+	defer blob.Close()
+	n, err := io.Copy(blob, src)
+	if err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	if n != size {
+		return fmt.Errorf("expected %d bytes to be written but was %d", size, n)
+	}
+	return nil
+}
+
+func run(addr, dbPath, authPath string) error {
+	dbPool, err := sqlitex.Open(dbPath, 0, 10)
+	if err != nil {
+		return fmt.Errorf("sqlitex.Open: %w", err)
+	}
+	defer dbPool.Close()
+
+	if err := prepareDatabase(context.TODO(), dbPool); err != nil {
+		return err
+	}
+
+	cfg, err := loadAuthConfig(authPath)
+	if err != nil {
+		return fmt.Errorf("loadAuthConfig: %w", err)
+	}
+
+	fs := &sqliteFS{dbPool: dbPool}
+	handler := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	log.Println("listening on:", addr)
+	return http.ListenAndServe(addr, basicAuth(cfg, copyMiddleware(fs, handler)))
+}
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	dbPath := flag.String("db", "files.db", "path to the sqlite database holding the files table")
+	authPath := flag.String("auth", "auth.json", "path to a JSON file with {\"username\":..,\"password_hash\":bcrypt-hash}")
+	flag.Parse()
+
+	if err := run(*addr, *dbPath, *authPath); err != nil {
+		log.Fatal(err)
+	}
+}